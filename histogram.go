@@ -0,0 +1,250 @@
+package mackerel
+
+import (
+	"math"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// quantiles are the percentiles reported for every histogram, mirroring the
+// fixed set statsd_exporter-style consumers expect.
+var quantiles = []struct {
+	suffix string
+	q      float64
+}{
+	{"p50", 0.50},
+	{"p90", 0.90},
+	{"p95", 0.95},
+	{"p99", 0.99},
+}
+
+// maxBuckets bounds the number of populated buckets per sign before
+// Histogram lowers its schema by one, halving its resolution, and
+// re-buckets existing observations. This
+// keeps memory bounded while letting the effective range adapt to the
+// data, following the approach used by Prometheus native histograms.
+const maxBuckets = 160
+
+// defaultSchema is the initial resolution: base = 2^(2^-schema), so schema 3
+// gives a base of roughly 1.09, i.e. ~9% per-bucket relative error.
+const defaultSchema = 3
+
+// zeroThreshold is the half-width of the bucket collapsed into the zero
+// count; observations with |v| below this are not bucketed individually.
+const zeroThreshold = 1e-9
+
+// Histogram is a base-2 exponential (sparse) histogram aggregator, in the
+// style of Prometheus native histograms. It requires no pre-declared
+// bucket boundaries: the schema drops by one, halving the resolution,
+// whenever a sign's bucket count would exceed maxBuckets.
+//
+// Histogram is not safe for concurrent use; callers serialize access the
+// same way the OpenTelemetry SDK serializes aggregator updates.
+type Histogram struct {
+	schema int
+	zero   uint64
+	pos    map[int]uint64
+	neg    map[int]uint64
+	count  uint64
+	sum    float64
+	min    float64
+	max    float64
+}
+
+// NewHistogram returns an empty Histogram.
+func NewHistogram() *Histogram {
+	return &Histogram{
+		schema: defaultSchema,
+		pos:    make(map[int]uint64),
+		neg:    make(map[int]uint64),
+	}
+}
+
+// Observe records v.
+func (h *Histogram) Observe(v float64) {
+	if h.count == 0 || v < h.min {
+		h.min = v
+	}
+	if h.count == 0 || v > h.max {
+		h.max = v
+	}
+	h.count++
+	h.sum += v
+
+	if math.Abs(v) < zeroThreshold {
+		h.zero++
+		return
+	}
+	buckets := h.pos
+	if v < 0 {
+		buckets = h.neg
+		v = -v
+	}
+	buckets[h.index(v)]++
+	h.rescaleIfNeeded()
+}
+
+// base returns the bucket growth factor for the current schema.
+func (h *Histogram) base() float64 {
+	return math.Pow(2, math.Pow(2, -float64(h.schema)))
+}
+
+// index returns the bucket index i such that base^i <= v < base^(i+1).
+func (h *Histogram) index(v float64) int {
+	return int(math.Floor(math.Log(v) / math.Log(h.base())))
+}
+
+// rescaleIfNeeded lowers the schema by one, merging adjacent buckets by shifting
+// indices right by one, until both sign's bucket counts fit within
+// maxBuckets.
+func (h *Histogram) rescaleIfNeeded() {
+	for len(h.pos) > maxBuckets || len(h.neg) > maxBuckets {
+		h.schema--
+		h.pos = rescale(h.pos)
+		h.neg = rescale(h.neg)
+	}
+}
+
+func rescale(buckets map[int]uint64) map[int]uint64 {
+	out := make(map[int]uint64, len(buckets))
+	for i, n := range buckets {
+		out[i>>1] += n
+	}
+	return out
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 { return h.count }
+
+// Sum returns the sum of observed values.
+func (h *Histogram) Sum() float64 { return h.sum }
+
+// Min returns the smallest observed value.
+func (h *Histogram) Min() float64 { return h.min }
+
+// Max returns the largest observed value.
+func (h *Histogram) Max() float64 { return h.max }
+
+// Quantile estimates the value at quantile q (0 <= q <= 1) by walking
+// buckets in ascending order and linearly interpolating within the bucket
+// that contains the q-th observation.
+func (h *Histogram) Quantile(q float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(q * float64(h.count)))
+	if target == 0 {
+		target = 1
+	}
+
+	base := h.base()
+	var seen uint64
+
+	for _, i := range sortedIndexes(h.neg, true) {
+		seen += h.neg[i]
+		if seen >= target {
+			return -interpolate(base, i, h.neg[i], seen-target)
+		}
+	}
+	seen += h.zero
+	if seen >= target {
+		return 0
+	}
+	for _, i := range sortedIndexes(h.pos, false) {
+		n := h.pos[i]
+		if seen+n >= target {
+			return interpolate(base, i, n, target-seen-1)
+		}
+		seen += n
+	}
+	return h.max
+}
+
+// interpolate returns a value within [base^i, base^(i+1)) proportional to
+// rank among the n observations that bucket holds.
+func interpolate(base float64, i int, n uint64, rank uint64) float64 {
+	lo := math.Pow(base, float64(i))
+	hi := math.Pow(base, float64(i+1))
+	if n <= 1 {
+		return (lo + hi) / 2
+	}
+	return lo + (hi-lo)*float64(rank)/float64(n-1)
+}
+
+func sortedIndexes(buckets map[int]uint64, descending bool) []int {
+	a := make([]int, 0, len(buckets))
+	for i := range buckets {
+		a = append(a, i)
+	}
+	for i := 1; i < len(a); i++ {
+		for j := i; j > 0; j-- {
+			less := a[j] < a[j-1]
+			if descending {
+				less = a[j] > a[j-1]
+			}
+			if !less {
+				break
+			}
+			a[j], a[j-1] = a[j-1], a[j]
+		}
+	}
+	return a
+}
+
+// NewHistogramGraphDef returns Mackerel Graph Definitions for a Histogram
+// exported under name: one metric per quantile plus max, min, count and
+// sum, mirroring the naming rules NewGraphDef uses for simple instruments.
+func NewHistogramGraphDef(name string, opts GraphDefOptions) (*mackerel.GraphDefsParam, error) {
+	if opts.Unit == "" {
+		opts.Unit = UnitDimensionless
+	}
+	switch {
+	case opts.MetricName == "" && opts.Name == "":
+		opts.MetricName = generalizeMetricName(name)
+		opts.Name = opts.MetricName
+	case opts.MetricName == "" && opts.Name != "":
+		s, err := bindGraphMetricName(opts.Name, name)
+		if err != nil {
+			return nil, err
+		}
+		opts.MetricName = s
+	case opts.MetricName != "" && opts.Name == "":
+		opts.Name = opts.MetricName
+	}
+	if !MetricName(opts.MetricName).Match(name) {
+		return nil, errMismatch
+	}
+
+	suffixes := make([]string, 0, len(quantiles)+4)
+	for _, qq := range quantiles {
+		suffixes = append(suffixes, qq.suffix)
+	}
+	suffixes = append(suffixes, "max", "min", "count", "sum")
+
+	metrics := make([]*mackerel.GraphDefsMetric, 0, len(suffixes))
+	for _, suffix := range suffixes {
+		metrics = append(metrics, &mackerel.GraphDefsMetric{
+			Name: "custom." + opts.MetricName + metricNameSep + suffix,
+		})
+	}
+	return &mackerel.GraphDefsParam{
+		Name:    "custom." + opts.Name,
+		Unit:    GraphUnit(opts.Unit),
+		Metrics: metrics,
+	}, nil
+}
+
+// MetricValues returns the set of Mackerel custom metric name/value pairs
+// that represent the current state of h, keyed by the fully-qualified
+// "custom.<name>.<suffix>" metric name NewHistogramGraphDef declares.
+func (h *Histogram) MetricValues(name string) map[string]float64 {
+	values := make(map[string]float64, len(quantiles)+4)
+	for _, qq := range quantiles {
+		values["custom."+name+metricNameSep+qq.suffix] = h.Quantile(qq.q)
+	}
+	values["custom."+name+metricNameSep+"max"] = h.Max()
+	values["custom."+name+metricNameSep+"min"] = h.Min()
+	values["custom."+name+metricNameSep+"count"] = float64(h.Count())
+	values["custom."+name+metricNameSep+"sum"] = h.Sum()
+	return values
+}
@@ -0,0 +1,100 @@
+package mackerel
+
+import (
+	"math"
+	"testing"
+)
+
+func withinRelativeError(got, want, rel float64) bool {
+	if want == 0 {
+		return math.Abs(got) <= rel
+	}
+	return math.Abs(got-want)/math.Abs(want) <= rel
+}
+
+func TestHistogramQuantiles(t *testing.T) {
+	h := NewHistogram()
+	for i := 1; i <= 1000; i++ {
+		h.Observe(float64(i))
+	}
+
+	if got, want := h.Count(), uint64(1000); got != want {
+		t.Fatalf("Count() = %d, want %d", got, want)
+	}
+	if got, want := h.Min(), 1.0; got != want {
+		t.Fatalf("Min() = %v, want %v", got, want)
+	}
+	if got, want := h.Max(), 1000.0; got != want {
+		t.Fatalf("Max() = %v, want %v", got, want)
+	}
+
+	// The schema's bucket width is ~9%, so quantile estimates should land
+	// within that relative error of the true value.
+	cases := []struct {
+		q    float64
+		want float64
+	}{
+		{0.50, 500},
+		{0.90, 900},
+		{0.99, 990},
+	}
+	for _, c := range cases {
+		got := h.Quantile(c.q)
+		if !withinRelativeError(got, c.want, 0.12) {
+			t.Errorf("Quantile(%v) = %v, want ~%v (within 12%%)", c.q, got, c.want)
+		}
+	}
+}
+
+func TestHistogramNegativeAndZeroObservations(t *testing.T) {
+	h := NewHistogram()
+	h.Observe(-10)
+	h.Observe(0)
+	h.Observe(10)
+
+	if got, want := h.Count(), uint64(3); got != want {
+		t.Fatalf("Count() = %d, want %d", got, want)
+	}
+	if got, want := h.Sum(), 0.0; got != want {
+		t.Fatalf("Sum() = %v, want %v", got, want)
+	}
+	if got := h.Quantile(0.5); !withinRelativeError(got, 0, 1) {
+		t.Errorf("Quantile(0.5) = %v, want ~0", got)
+	}
+}
+
+func TestHistogramRescalesWhenBucketsOverflow(t *testing.T) {
+	h := NewHistogram()
+	// A wide enough range, at the default schema, would need more than
+	// maxBuckets buckets; Observe must rescale instead of growing
+	// unbounded.
+	for i := 0; i < 2*maxBuckets; i++ {
+		h.Observe(math.Pow(2, float64(i)/4))
+	}
+	if len(h.pos) > maxBuckets {
+		t.Fatalf("len(pos) = %d, want <= %d", len(h.pos), maxBuckets)
+	}
+	if h.schema >= defaultSchema {
+		t.Fatalf("schema = %d, want it to have been reduced below %d", h.schema, defaultSchema)
+	}
+}
+
+func TestNewHistogramGraphDef(t *testing.T) {
+	gd, err := NewHistogramGraphDef("http.server.duration", GraphDefOptions{})
+	if err != nil {
+		t.Fatalf("NewHistogramGraphDef: %v", err)
+	}
+	if gd.Name != "custom.http.server.*" {
+		t.Fatalf("Name = %q, want %q", gd.Name, "custom.http.server.*")
+	}
+	want := "custom.http.server.*.p99"
+	var found bool
+	for _, m := range gd.Metrics {
+		if m.Name == want {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Metrics = %+v, want one named %q", gd.Metrics, want)
+	}
+}
@@ -0,0 +1,63 @@
+package mackerel
+
+import "container/list"
+
+// mapperCache is a fixed-size LRU cache from a fingerprint to the result of
+// matching it against a MetricMapper's rules. It is not safe for concurrent
+// use on its own; MetricMapper serializes access with its own mutex.
+type mapperCache struct {
+	size int
+	ll   *list.List
+	m    map[string]*list.Element
+}
+
+type mapperCacheEntry struct {
+	key  string
+	opts MetricMapOptions
+	ok   bool
+}
+
+func newMapperCache(size int) *mapperCache {
+	return &mapperCache{
+		size: size,
+		ll:   list.New(),
+		m:    make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached result for key. found reports whether key was in
+// the cache at all; matched, only meaningful when found is true, reports
+// whether that cached result was a rule match. A cached non-match (found
+// true, matched false) must still short-circuit the caller's lookup.
+func (c *mapperCache) get(key string) (opts MetricMapOptions, matched bool, found bool) {
+	e, ok := c.m[key]
+	if !ok {
+		return MetricMapOptions{}, false, false
+	}
+	c.ll.MoveToFront(e)
+	ent := e.Value.(*mapperCacheEntry)
+	return ent.opts, ent.ok, true
+}
+
+func (c *mapperCache) add(key string, opts MetricMapOptions, ok bool) {
+	if e, found := c.m[key]; found {
+		c.ll.MoveToFront(e)
+		e.Value.(*mapperCacheEntry).opts = opts
+		e.Value.(*mapperCacheEntry).ok = ok
+		return
+	}
+	e := c.ll.PushFront(&mapperCacheEntry{key: key, opts: opts, ok: ok})
+	c.m[key] = e
+	if c.size > 0 && c.ll.Len() > c.size {
+		c.removeOldest()
+	}
+}
+
+func (c *mapperCache) removeOldest() {
+	e := c.ll.Back()
+	if e == nil {
+		return
+	}
+	c.ll.Remove(e)
+	delete(c.m, e.Value.(*mapperCacheEntry).key)
+}
@@ -0,0 +1,33 @@
+package mackerel
+
+import "testing"
+
+func TestMapperCacheNegativeMatch(t *testing.T) {
+	c := newMapperCache(10)
+	c.add("miss", MetricMapOptions{}, false)
+
+	opts, matched, found := c.get("miss")
+	if !found {
+		t.Fatalf("get(%q): found = false, want true", "miss")
+	}
+	if matched {
+		t.Fatalf("get(%q): matched = true, want false", "miss")
+	}
+	if opts != (MetricMapOptions{}) {
+		t.Fatalf("get(%q): opts = %+v, want zero value", "miss", opts)
+	}
+}
+
+func TestMapperCacheEviction(t *testing.T) {
+	c := newMapperCache(2)
+	c.add("a", MetricMapOptions{Name: "a"}, true)
+	c.add("b", MetricMapOptions{Name: "b"}, true)
+	c.add("c", MetricMapOptions{Name: "c"}, true)
+
+	if _, _, found := c.get("a"); found {
+		t.Fatalf("get(%q): found = true, want false (should have been evicted)", "a")
+	}
+	if _, matched, found := c.get("c"); !found || !matched {
+		t.Fatalf("get(%q): found = %v, matched = %v, want true, true", "c", found, matched)
+	}
+}
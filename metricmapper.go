@@ -0,0 +1,202 @@
+package mackerel
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/api/core"
+	"go.opentelemetry.io/otel/api/unit"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// MatchType describes how a MapperRule matches an instrument name.
+type MatchType string
+
+const (
+	// MatchTypeGlob matches names with '*' and '#' wildcards, the same
+	// rules as MetricName.Match.
+	MatchTypeGlob MatchType = "glob"
+	// MatchTypeRegex matches names against a regular expression. Capture
+	// groups are referenceable from Name and MetricName as "${1}", "${2}", etc.
+	MatchTypeRegex MatchType = "regex"
+)
+
+// MapperRule is a single rule in a MapperConfig. It translates an
+// OpenTelemetry instrument name, optionally qualified by its labels, into
+// Mackerel graph and metric names.
+type MapperRule struct {
+	Match           string            `yaml:"match"`
+	MatchType       MatchType         `yaml:"match_type"`
+	MatchMetricType map[string]string `yaml:"match_metric_type"`
+	Name            string            `yaml:"name"`
+	MetricName      string            `yaml:"metric_name"`
+	Unit            string            `yaml:"unit"`
+
+	re *regexp.Regexp
+}
+
+// MapperConfig is the top-level structure of a metric mapping file.
+type MapperConfig struct {
+	Rules []MapperRule `yaml:"mappings"`
+}
+
+// MetricMapOptions is the result of mapping an instrument name through a
+// MetricMapper; it fills GraphDefOptions for NewGraphDef.
+type MetricMapOptions struct {
+	Name       string
+	MetricName string
+	Unit       unit.Unit
+	Kind       core.NumberKind
+}
+
+// MetricMapper translates OpenTelemetry instrument names and label sets
+// into Mackerel graph and metric names, in the spirit of statsd_exporter's
+// mapping configuration. Rules are evaluated in order; the first match wins.
+//
+// MetricMapper is safe for concurrent use.
+type MetricMapper struct {
+	rules []MapperRule
+
+	mu    sync.Mutex
+	cache *mapperCache
+}
+
+// defaultCacheSize bounds the number of (name, label fingerprint) lookups
+// that LoadMapperConfig keeps memoized before evicting the least recently
+// used entry.
+const defaultCacheSize = 1000
+
+// LoadMapperConfig parses a YAML mapping configuration, as documented on
+// MapperRule, and returns a MetricMapper that applies it.
+func LoadMapperConfig(data []byte) (*MetricMapper, error) {
+	var c MapperConfig
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("mackerel: cannot parse mapper config: %w", err)
+	}
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if r.Match == "" {
+			return nil, fmt.Errorf("mackerel: mapping rule %d has no match pattern", i)
+		}
+		if r.MatchType == "" {
+			r.MatchType = MatchTypeGlob
+		}
+		if r.MatchType == MatchTypeRegex {
+			re, err := regexp.Compile("^" + r.Match + "$")
+			if err != nil {
+				return nil, fmt.Errorf("mackerel: mapping rule %d: %w", i, err)
+			}
+			r.re = re
+		}
+	}
+	return &MetricMapper{
+		rules: c.Rules,
+		cache: newMapperCache(defaultCacheSize),
+	}, nil
+}
+
+// Map returns the MetricMapOptions for name and labels, and whether a rule
+// matched. Results are cached by (name, sorted label fingerprint) so that
+// repeated calls on a hot path do not re-evaluate every rule.
+func (m *MetricMapper) Map(name string, labels map[string]string) (MetricMapOptions, bool) {
+	key := fingerprint(name, labels)
+
+	m.mu.Lock()
+	if opts, matched, found := m.cache.get(key); found {
+		m.mu.Unlock()
+		return opts, matched
+	}
+	m.mu.Unlock()
+
+	opts, ok := m.match(name, labels)
+
+	m.mu.Lock()
+	m.cache.add(key, opts, ok)
+	m.mu.Unlock()
+	return opts, ok
+}
+
+func (m *MetricMapper) match(name string, labels map[string]string) (MetricMapOptions, bool) {
+	for _, r := range m.rules {
+		groups, ok := r.matches(name)
+		if !ok {
+			continue
+		}
+		if !matchesLabels(r.MatchMetricType, labels) {
+			continue
+		}
+		return MetricMapOptions{
+			Name:       expand(r.Name, groups),
+			MetricName: expand(r.MetricName, groups),
+			Unit:       unit.Unit(r.Unit),
+		}, true
+	}
+	return MetricMapOptions{}, false
+}
+
+// matches reports whether name satisfies the rule, returning the groups
+// available for expansion ("${0}", "${1}", ...). For a regex rule these are
+// the submatches, "${0}" being the whole match; for a glob rule they are
+// name's dot-separated segments, "${0}" being the first.
+func (r *MapperRule) matches(name string) ([]string, bool) {
+	if r.MatchType == MatchTypeRegex {
+		m := r.re.FindStringSubmatch(name)
+		if m == nil {
+			return nil, false
+		}
+		return m, true
+	}
+	if !MetricName(r.Match).Match(name) {
+		return nil, false
+	}
+	return strings.Split(name, metricNameSep), true
+}
+
+func matchesLabels(want map[string]string, labels map[string]string) bool {
+	for k, v := range want {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+var groupRefPattern = regexp.MustCompile(`\$\{(\d+)\}`)
+
+// expand substitutes "${n}" references in s with groups[n].
+func expand(s string, groups []string) string {
+	return groupRefPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		n, err := strconv.Atoi(ref[2 : len(ref)-1])
+		if err != nil || n >= len(groups) {
+			return ref
+		}
+		return groups[n]
+	})
+}
+
+// fingerprint returns a stable key for name and its label set, independent
+// of the order labels were supplied in.
+func fingerprint(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		b.WriteByte('\x00')
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(labels[k])
+	}
+	return b.String()
+}
@@ -0,0 +1,44 @@
+package mackerel
+
+import "testing"
+
+func TestMetricMapperCachesNonMatch(t *testing.T) {
+	m, err := LoadMapperConfig([]byte(`
+mappings:
+  - match: "http.*"
+    name: "http.${1}"
+`))
+	if err != nil {
+		t.Fatalf("LoadMapperConfig: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, ok := m.Map("grpc.duration", nil)
+		if ok {
+			t.Fatalf("Map(%q) iteration %d: matched = true, want false", "grpc.duration", i)
+		}
+	}
+	if _, matched, found := m.cache.get("grpc.duration"); !found || matched {
+		t.Fatalf("cache.get after repeated non-matching Map: found=%v matched=%v, want true, false", found, matched)
+	}
+}
+
+func TestMetricMapperMatch(t *testing.T) {
+	m, err := LoadMapperConfig([]byte(`
+mappings:
+  - match: "http.server.*"
+    name: "http.server.${2}"
+    unit: Milliseconds
+`))
+	if err != nil {
+		t.Fatalf("LoadMapperConfig: %v", err)
+	}
+
+	opts, ok := m.Map("http.server.duration", nil)
+	if !ok {
+		t.Fatalf("Map: matched = false, want true")
+	}
+	if opts.Name != "http.server.duration" {
+		t.Fatalf("opts.Name = %q, want %q", opts.Name, "http.server.duration")
+	}
+}
@@ -0,0 +1,224 @@
+package mackerel
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// monitorManagedMemo marks a monitor as owned by this exporter, so that a
+// MonitorReconciler can tell its own monitors apart from ones configured
+// by hand or by another tool, and never touches the latter.
+const monitorManagedMemo = "managed-by:mackerelexporter-go"
+
+// CheckMonitorOptions configures the host-metric monitor NewCheckMonitor
+// produces from an OpenTelemetry instrument's threshold hints.
+type CheckMonitorOptions struct {
+	// Metric is the Mackerel metric name the monitor watches, e.g.
+	// "custom.http.server.duration.p99".
+	Metric string
+
+	// Operator is the comparison applied to Metric: ">" or "<".
+	Operator string
+
+	// Warning and Critical are the thresholds that trigger each alert
+	// level. At least one must be set.
+	Warning  *float64
+	Critical *float64
+
+	// Duration is how many consecutive minutes the threshold must be
+	// crossed before the monitor fires.
+	Duration uint64
+
+	// NotificationInterval is how often, in minutes, a firing monitor
+	// re-notifies. Zero means Mackerel's default (no repeat).
+	NotificationInterval uint64
+
+	// Scopes restricts the monitor to hosts in these roles or services.
+	// An empty value monitors every host exposing Metric.
+	Scopes []string
+
+	// Memo is appended to the monitor's memo, below the exporter's own
+	// ownership marker.
+	Memo string
+}
+
+var (
+	errNoMetric     = errors.New("mackerel: check monitor requires a Metric")
+	errNoOperator   = errors.New("mackerel: check monitor operator must be \">\" or \"<\"")
+	errNoThresholds = errors.New("mackerel: check monitor requires Warning or Critical")
+)
+
+// NewCheckMonitor returns a Mackerel host-metric monitor definition named
+// name, built from opts. The returned monitor is tagged so that a
+// MonitorReconciler run against the same Mackerel organization recognizes
+// it as managed by this exporter.
+func NewCheckMonitor(name string, opts CheckMonitorOptions) (*mackerel.MonitorHostMetric, error) {
+	if opts.Metric == "" {
+		return nil, errNoMetric
+	}
+	if opts.Operator != ">" && opts.Operator != "<" {
+		return nil, errNoOperator
+	}
+	if opts.Warning == nil && opts.Critical == nil {
+		return nil, errNoThresholds
+	}
+	memo := monitorManagedMemo
+	if opts.Memo != "" {
+		memo += "\n" + opts.Memo
+	}
+	return &mackerel.MonitorHostMetric{
+		Name:                 name,
+		Memo:                 memo,
+		Type:                 "host",
+		Metric:               opts.Metric,
+		Operator:             opts.Operator,
+		Warning:              opts.Warning,
+		Critical:             opts.Critical,
+		Duration:             opts.Duration,
+		NotificationInterval: opts.NotificationInterval,
+		Scopes:               opts.Scopes,
+	}, nil
+}
+
+func isManagedMonitor(m *mackerel.MonitorHostMetric) bool {
+	return len(m.Memo) >= len(monitorManagedMemo) && m.Memo[:len(monitorManagedMemo)] == monitorManagedMemo
+}
+
+// MonitorReconcilerOptions configures a MonitorReconciler.
+type MonitorReconcilerOptions struct {
+	// DryRun computes the changes Reconcile would make without calling
+	// the Mackerel API.
+	DryRun bool
+}
+
+// ReconcileResult reports the monitor names a Reconcile call created,
+// updated or deleted.
+type ReconcileResult struct {
+	Created []string
+	Updated []string
+	Deleted []string
+}
+
+// MonitorReconciler diffs a desired set of check monitors, as produced by
+// NewCheckMonitor, against Mackerel's monitors API, creating, updating and
+// deleting monitors this exporter owns so that it ends up matching. It
+// never touches a monitor it does not own.
+type MonitorReconciler struct {
+	client *mackerel.Client
+	opts   MonitorReconcilerOptions
+}
+
+// NewMonitorReconciler returns a MonitorReconciler that reconciles through
+// client according to opts.
+func NewMonitorReconciler(client *mackerel.Client, opts MonitorReconcilerOptions) *MonitorReconciler {
+	return &MonitorReconciler{client: client, opts: opts}
+}
+
+// Reconcile brings Mackerel's monitors in line with desired: monitors
+// Reconcile previously created that are missing from desired are deleted,
+// monitors present in both but differing are updated, and monitors only
+// in desired are created. Monitors this exporter doesn't own are left
+// untouched, whether or not their name collides with one in desired.
+func (r *MonitorReconciler) Reconcile(desired []*mackerel.MonitorHostMetric) (*ReconcileResult, error) {
+	remote, err := r.client.FindMonitors()
+	if err != nil {
+		return nil, err
+	}
+
+	owned := make(map[string]*mackerel.MonitorHostMetric)
+	for _, m := range remote {
+		hm, ok := m.(*mackerel.MonitorHostMetric)
+		if !ok || !isManagedMonitor(hm) {
+			continue
+		}
+		owned[hm.Name] = hm
+	}
+
+	result := &ReconcileResult{}
+	seen := make(map[string]bool, len(desired))
+	for _, d := range desired {
+		seen[d.Name] = true
+		cur, ok := owned[d.Name]
+		if !ok {
+			result.Created = append(result.Created, d.Name)
+			if r.opts.DryRun {
+				continue
+			}
+			if _, err := r.client.CreateMonitor(d); err != nil {
+				return result, err
+			}
+			continue
+		}
+		if monitorThresholdsEqual(cur, d) {
+			continue
+		}
+		result.Updated = append(result.Updated, d.Name)
+		if r.opts.DryRun {
+			continue
+		}
+		d.ID = cur.ID
+		if _, err := r.client.UpdateMonitor(cur.ID, d); err != nil {
+			return result, err
+		}
+	}
+
+	for name, cur := range owned {
+		if seen[name] {
+			continue
+		}
+		result.Deleted = append(result.Deleted, name)
+		if r.opts.DryRun {
+			continue
+		}
+		if _, err := r.client.DeleteMonitor(cur.ID); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func monitorThresholdsEqual(a, b *mackerel.MonitorHostMetric) bool {
+	return a.Metric == b.Metric &&
+		a.Operator == b.Operator &&
+		floatPtrEqual(a.Warning, b.Warning) &&
+		floatPtrEqual(a.Critical, b.Critical) &&
+		a.Duration == b.Duration &&
+		a.NotificationInterval == b.NotificationInterval &&
+		a.Memo == b.Memo &&
+		scopesEqual(a.Scopes, b.Scopes)
+}
+
+// scopesEqual reports whether a and b name the same set of scopes.
+// Mackerel does not guarantee the order it returns scopes in, and may
+// normalize their casing, so scopes are compared as a case-insensitive
+// set rather than an ordered list.
+func scopesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	norm := func(scopes []string) []string {
+		out := make([]string, len(scopes))
+		for i, s := range scopes {
+			out[i] = strings.ToLower(s)
+		}
+		sort.Strings(out)
+		return out
+	}
+	na, nb := norm(a), norm(b)
+	for i := range na {
+		if na[i] != nb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func floatPtrEqual(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,20 @@
+package mackerel
+
+import "testing"
+
+func TestScopesEqualIgnoresOrderAndCase(t *testing.T) {
+	cases := []struct {
+		a, b []string
+		want bool
+	}{
+		{[]string{"role:a", "role:b"}, []string{"role:b", "role:a"}, true},
+		{[]string{"Role:A"}, []string{"role:a"}, true},
+		{[]string{"role:a"}, []string{"role:a", "role:b"}, false},
+		{nil, nil, true},
+	}
+	for _, c := range cases {
+		if got := scopesEqual(c.a, c.b); got != c.want {
+			t.Errorf("scopesEqual(%v, %v) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
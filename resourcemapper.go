@@ -0,0 +1,267 @@
+package mackerel
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/api/core"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// hostMetadataNamespace is the namespace ResourceMapper stores materialized
+// OTel resource attributes under via PutHostMetaData.
+const hostMetadataNamespace = "otel-resource"
+
+// defaultRenewInterval is how often HostID re-pushes a host's identity
+// attributes (name, roles, metadata) to Mackerel when ResourceMapperOptions
+// doesn't specify one.
+const defaultRenewInterval = time.Hour
+
+// Resource describes the entity a set of metrics was collected from, as a
+// set of OpenTelemetry resource attributes (e.g. "service.name",
+// "host.name", "k8s.pod.name").
+type Resource []core.KeyValue
+
+// Get returns the value of the attribute named key, and whether it was
+// present.
+func (r Resource) Get(key string) (string, bool) {
+	for _, kv := range r {
+		if string(kv.Key) == key {
+			v := kv.Value
+			return v.AsString(), true
+		}
+	}
+	return "", false
+}
+
+// ResourceMapperOptions configures a ResourceMapper.
+type ResourceMapperOptions struct {
+	// HostnameKeys are resource attribute keys tried, in order, to derive
+	// the Mackerel host's display name. The first present key wins.
+	HostnameKeys []string
+
+	// RoleKeys are resource attribute keys whose values become Mackerel
+	// roles (e.g. "service.namespace"), qualified by the resource's
+	// "service.name" attribute, or by ServiceName if it has none.
+	RoleKeys []string
+
+	// IdentifyingKeys are resource attribute keys that together uniquely
+	// identify a host (e.g. "service.instance.id", "k8s.pod.name"). Their
+	// values are hashed to derive the cache key under which a host ID is
+	// registered and renewed.
+	IdentifyingKeys []string
+
+	// MetaKeys are resource attribute keys materialized onto the host as
+	// metadata (via PutHostMetaData, under the "otel-resource" namespace)
+	// instead of as host identity.
+	MetaKeys []string
+
+	// SuffixKeys are resource attribute keys whose values MetricNameSuffix
+	// joins into a dotted suffix, for callers that need to disambiguate
+	// metric names by resource instead of by host (e.g. several
+	// containers reporting through one host).
+	SuffixKeys []string
+
+	// RenewInterval is how often an already-registered host's name, roles
+	// and metadata are re-pushed to Mackerel, in case they changed. Zero
+	// means defaultRenewInterval.
+	RenewInterval time.Duration
+
+	// ServiceName is the Mackerel service resources without a
+	// "service.name" attribute are registered under, both for roles and
+	// for service-metrics mode.
+	ServiceName string
+}
+
+// ResourceMapper turns OpenTelemetry Resources into Mackerel host identity,
+// registering and renewing hosts against the Mackerel API as needed, or
+// routes resources that carry no host identity to Mackerel's service
+// metrics API instead.
+//
+// ResourceMapper is safe for concurrent use.
+type ResourceMapper struct {
+	client *mackerel.Client
+	opts   ResourceMapperOptions
+
+	mu    sync.Mutex
+	hosts map[string]*hostSlot // identity hash -> registration slot
+}
+
+type registeredHost struct {
+	id        string
+	renewedAt time.Time
+}
+
+// hostSlot serializes registration for a single identity hash, so that
+// concurrent HostID calls for the same never-before-seen resource don't
+// race to CreateHost a duplicate. The slot itself is found or inserted
+// under ResourceMapper.mu, but registering or renewing the host it guards
+// happens under slot.mu, which callers hold across the slow Mackerel API
+// calls; a concurrent caller for the same hash blocks on slot.mu and then
+// reuses whatever host the winner registered.
+type hostSlot struct {
+	mu   sync.Mutex
+	host *registeredHost
+}
+
+// NewResourceMapper returns a ResourceMapper that registers hosts through
+// client according to opts.
+func NewResourceMapper(client *mackerel.Client, opts ResourceMapperOptions) *ResourceMapper {
+	if opts.RenewInterval <= 0 {
+		opts.RenewInterval = defaultRenewInterval
+	}
+	return &ResourceMapper{
+		client: client,
+		opts:   opts,
+		hosts:  make(map[string]*hostSlot),
+	}
+}
+
+// HostID returns the Mackerel host ID that r should be reported under,
+// registering a new host or renewing an existing one as needed. ok is
+// false when r does not carry enough identifying attributes to be treated
+// as a host, in which case the resource should be reported with
+// PostServiceMetrics instead. err is non-nil only when ok is true but the
+// Mackerel API call failed; callers must not treat that as "no identity"
+// and fall back to service metrics, since doing so would silently
+// misroute a host's metrics on a transient error.
+func (m *ResourceMapper) HostID(r Resource) (id string, ok bool, err error) {
+	hash, ok := m.identityHash(r)
+	if !ok {
+		return "", false, nil
+	}
+
+	slot := m.slotFor(hash)
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+
+	host := slot.host
+	if host != nil && time.Since(host.renewedAt) < m.opts.RenewInterval {
+		return host.id, true, nil
+	}
+
+	if host == nil {
+		hostID, err := m.client.CreateHost(m.hostParam(r))
+		if err != nil {
+			return "", true, err
+		}
+		host = &registeredHost{id: hostID}
+	} else if _, err := m.client.UpdateHost(host.id, (*mackerel.UpdateHostParam)(m.hostParam(r))); err != nil {
+		// The host is still registered under host.id; only the renewal
+		// failed, so keep serving it and let the next call retry.
+		return host.id, true, err
+	}
+
+	if err := m.putMetadata(host.id, r); err != nil {
+		slot.host = host
+		return host.id, true, err
+	}
+
+	host.renewedAt = time.Now()
+	slot.host = host
+	return host.id, true, nil
+}
+
+// slotFor returns the hostSlot that serializes registration for hash,
+// creating it if this is the first call to see that identity.
+func (m *ResourceMapper) slotFor(hash string) *hostSlot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	slot, ok := m.hosts[hash]
+	if !ok {
+		slot = &hostSlot{}
+		m.hosts[hash] = slot
+	}
+	return slot
+}
+
+// MetricNameSuffix returns a dotted suffix built from opts.SuffixKeys
+// present in r, for callers that need to disambiguate metric names by
+// resource rather than by host. It is empty when none of SuffixKeys are
+// present in r.
+func (m *ResourceMapper) MetricNameSuffix(r Resource) string {
+	var parts []string
+	for _, key := range m.opts.SuffixKeys {
+		if v, ok := r.Get(key); ok {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, metricNameSep)
+}
+
+// PostServiceMetrics posts values for r's service, for resources that
+// HostID rejected. The service name is r's "service.name" attribute, or
+// opts.ServiceName if r does not carry one.
+func (m *ResourceMapper) PostServiceMetrics(r Resource, values []*mackerel.MetricValue) error {
+	name, ok := r.Get("service.name")
+	if !ok {
+		name = m.opts.ServiceName
+	}
+	return m.client.PostServiceMetricValues(name, values)
+}
+
+// putMetadata materializes opts.MetaKeys present in r onto the host as
+// metadata, if any are configured and present.
+func (m *ResourceMapper) putMetadata(hostID string, r Resource) error {
+	if len(m.opts.MetaKeys) == 0 {
+		return nil
+	}
+	meta := make(map[string]string, len(m.opts.MetaKeys))
+	for _, key := range m.opts.MetaKeys {
+		if v, ok := r.Get(key); ok {
+			meta[key] = v
+		}
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	return m.client.PutHostMetaData(hostID, hostMetadataNamespace, meta)
+}
+
+// identityHash returns a stable hash of r's identifying attributes, and
+// whether any were present.
+func (m *ResourceMapper) identityHash(r Resource) (string, bool) {
+	var parts []string
+	for _, key := range m.opts.IdentifyingKeys {
+		if v, ok := r.Get(key); ok {
+			parts = append(parts, key+"="+v)
+		}
+	}
+	if len(parts) == 0 {
+		return "", false
+	}
+	sort.Strings(parts)
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:]), true
+}
+
+func (m *ResourceMapper) hostParam(r Resource) *mackerel.CreateHostParam {
+	name := ""
+	for _, key := range m.opts.HostnameKeys {
+		if v, ok := r.Get(key); ok {
+			name = v
+			break
+		}
+	}
+
+	var roles []string
+	service := m.opts.ServiceName
+	if v, ok := r.Get("service.name"); ok {
+		service = v
+	}
+	for _, key := range m.opts.RoleKeys {
+		if v, ok := r.Get(key); ok && service != "" {
+			roles = append(roles, service+":"+v)
+		}
+	}
+
+	return &mackerel.CreateHostParam{
+		Name:          name,
+		RoleFullnames: roles,
+	}
+}
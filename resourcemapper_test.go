@@ -0,0 +1,63 @@
+package mackerel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mackerelio/mackerel-client-go"
+	"go.opentelemetry.io/otel/api/core"
+)
+
+// TestHostIDSingleFlightsRegistration reproduces many goroutines reporting
+// the same never-before-seen resource concurrently. Only one of them should
+// register a new host; the rest must reuse its ID instead of racing their
+// own CreateHost calls.
+func TestHostIDSingleFlightsRegistration(t *testing.T) {
+	var creates int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/api/v0/hosts" {
+			atomic.AddInt32(&creates, 1)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"id":"host1"}`))
+	}))
+	defer srv.Close()
+
+	client, err := mackerel.NewClientWithOptions("dummy", srv.URL, false)
+	if err != nil {
+		t.Fatalf("NewClientWithOptions: %v", err)
+	}
+	m := NewResourceMapper(client, ResourceMapperOptions{
+		IdentifyingKeys: []string{"service.instance.id"},
+	})
+	r := Resource{core.Key("service.instance.id").String("abc")}
+
+	const n = 20
+	var wg sync.WaitGroup
+	ids := make([]string, n)
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			id, ok, err := m.HostID(r)
+			if err != nil || !ok {
+				t.Errorf("HostID() = %q, %v, %v", id, ok, err)
+				return
+			}
+			ids[i] = id
+		}(i)
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&creates); got != 1 {
+		t.Fatalf("CreateHost calls = %d, want 1", got)
+	}
+	for i, id := range ids {
+		if id != "host1" {
+			t.Errorf("ids[%d] = %q, want %q", i, id, "host1")
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package mackerel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// maxBatchSize is the most metric values Mackerel accepts in a single
+// "/api/v0/tsdb" or service metrics call.
+const maxBatchSize = 300
+
+// SubmitterOptions configures a Submitter.
+type SubmitterOptions struct {
+	// BatchSize caps how many metric values are sent per API call. It is
+	// clamped to maxBatchSize.
+	BatchSize int
+
+	// FlushInterval is how often queued values are flushed to Mackerel.
+	FlushInterval time.Duration
+
+	// MaxRetries bounds the number of retries for a batch before it is
+	// dropped. Zero means retry forever.
+	MaxRetries int
+
+	// SpoolDir, if non-empty, is a directory where queued values are
+	// durably appended before being flushed, so that metrics survive a
+	// process restart or a prolonged Mackerel API outage. If empty,
+	// queued values that haven't been flushed are lost on restart.
+	SpoolDir string
+}
+
+func (o *SubmitterOptions) setDefaults() {
+	if o.BatchSize <= 0 || o.BatchSize > maxBatchSize {
+		o.BatchSize = maxBatchSize
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = 10 * time.Second
+	}
+}
+
+// SubmitterStats reports a Submitter's self-observability counters.
+type SubmitterStats struct {
+	Enqueued    uint64
+	Dropped     uint64
+	Retried     uint64
+	SpoolBytes  int64
+	SpoolErrors uint64
+}
+
+// destination identifies where a batch of metric values is posted to:
+// either a Mackerel host, or a Mackerel service (for resources with no
+// host identity; see ResourceMapper).
+type destination struct {
+	HostID      string `json:"hostId,omitempty"`
+	ServiceName string `json:"serviceName,omitempty"`
+}
+
+type spoolEntry struct {
+	Dest  destination           `json:"dest"`
+	Value *mackerel.MetricValue `json:"value"`
+}
+
+// Submitter sits between an exporter's collection callback and
+// mackerel-client-go, batching metric values and submitting them with
+// retry and backoff. If configured with a SpoolDir, it durably buffers
+// values on disk so they survive process restarts and Mackerel API
+// outages.
+//
+// Submitter is safe for concurrent use.
+type Submitter struct {
+	client *mackerel.Client
+	opts   SubmitterOptions
+	spool  *spool
+
+	// mu guards queue and spool: Enqueue must add an entry to both (or
+	// neither) under the same lock, otherwise a Flush racing with an
+	// Enqueue could read a queue snapshot that disagrees with what's on
+	// disk and rewrite the spool to something that's missing an entry.
+	mu    sync.Mutex
+	queue []spoolEntry
+
+	enqueued    uint64
+	dropped     uint64
+	retried     uint64
+	spoolErrors uint64
+}
+
+// NewSubmitter returns a Submitter that posts through client according to
+// opts. If opts.SpoolDir is set, any entries left over from a prior
+// process are replayed into the queue immediately.
+func NewSubmitter(client *mackerel.Client, opts SubmitterOptions) (*Submitter, error) {
+	opts.setDefaults()
+	s := &Submitter{client: client, opts: opts}
+	if opts.SpoolDir != "" {
+		sp, err := openSpool(opts.SpoolDir)
+		if err != nil {
+			return nil, fmt.Errorf("mackerel: cannot open spool: %w", err)
+		}
+		s.spool = sp
+		entries, err := sp.replay()
+		if err != nil {
+			return nil, fmt.Errorf("mackerel: cannot replay spool: %w", err)
+		}
+		s.queue = append(s.queue, entries...)
+	}
+	return s, nil
+}
+
+// Enqueue queues v for delivery to the host identified by hostID.
+func (s *Submitter) Enqueue(hostID string, v *mackerel.MetricValue) error {
+	return s.enqueue(spoolEntry{Dest: destination{HostID: hostID}, Value: v})
+}
+
+// EnqueueService queues v for delivery to the service identified by
+// serviceName, for resources that carry no host identity.
+func (s *Submitter) EnqueueService(serviceName string, v *mackerel.MetricValue) error {
+	return s.enqueue(spoolEntry{Dest: destination{ServiceName: serviceName}, Value: v})
+}
+
+func (s *Submitter) enqueue(e spoolEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.spool != nil {
+		if err := s.spool.append(e); err != nil {
+			return fmt.Errorf("mackerel: cannot spool metric value: %w", err)
+		}
+	}
+	s.queue = append(s.queue, e)
+	atomic.AddUint64(&s.enqueued, 1)
+	return nil
+}
+
+// Run flushes the queue every FlushInterval until ctx is done, at which
+// point it flushes once more and returns.
+func (s *Submitter) Run(ctx context.Context) error {
+	t := time.NewTicker(s.opts.FlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.Flush(ctx)
+		case <-ctx.Done():
+			s.Flush(ctx)
+			return ctx.Err()
+		}
+	}
+}
+
+// Flush sends all currently queued values, batched by destination and
+// capped at BatchSize values per call, retrying transport and server
+// errors with exponential backoff and dropping batches Mackerel rejects
+// outright. A retry waits for ctx between attempts, so a canceled ctx
+// stops retrying instead of blocking Run's shutdown; a batch that fails
+// after ctx is canceled is put back on the queue, and so stays in the
+// spool, rather than counted as dropped.
+func (s *Submitter) Flush(ctx context.Context) {
+	s.mu.Lock()
+	queue := s.queue
+	s.queue = nil
+	s.mu.Unlock()
+
+	byDest := make(map[destination][]*mackerel.MetricValue)
+	var order []destination
+	for _, e := range queue {
+		if _, ok := byDest[e.Dest]; !ok {
+			order = append(order, e.Dest)
+		}
+		byDest[e.Dest] = append(byDest[e.Dest], e.Value)
+	}
+
+	for _, dest := range order {
+		values := byDest[dest]
+		for len(values) > 0 {
+			n := s.opts.BatchSize
+			if n > len(values) {
+				n = len(values)
+			}
+			batch := values[:n]
+			values = values[n:]
+			s.submit(ctx, dest, batch)
+		}
+	}
+
+	if s.spool != nil {
+		// Rewrite the spool to hold exactly what's left in s.queue, rather
+		// than truncating it outright: Enqueue may have appended entries
+		// to both the spool file and the new s.queue while this Flush was
+		// busy submitting, and those entries must survive. Reading
+		// s.queue and rewriting the spool under the same lock that
+		// Enqueue uses to add to both is what keeps the two consistent;
+		// see the comment on Submitter.mu.
+		s.mu.Lock()
+		err := s.spool.rewrite(s.queue)
+		s.mu.Unlock()
+		if err != nil {
+			atomic.AddUint64(&s.spoolErrors, 1)
+		}
+	}
+}
+
+func (s *Submitter) submit(ctx context.Context, dest destination, values []*mackerel.MetricValue) {
+	attempt := 0
+	for {
+		err := s.post(dest, values)
+		if err == nil {
+			return
+		}
+		if !isRetriable(err) {
+			atomic.AddUint64(&s.dropped, uint64(len(values)))
+			return
+		}
+		attempt++
+		if s.opts.MaxRetries > 0 && attempt > s.opts.MaxRetries {
+			atomic.AddUint64(&s.dropped, uint64(len(values)))
+			return
+		}
+		atomic.AddUint64(&s.retried, uint64(len(values)))
+		select {
+		case <-time.After(backoff(attempt)):
+		case <-ctx.Done():
+			s.mu.Lock()
+			for _, v := range values {
+				s.queue = append(s.queue, spoolEntry{Dest: dest, Value: v})
+			}
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (s *Submitter) post(dest destination, values []*mackerel.MetricValue) error {
+	if dest.ServiceName != "" {
+		return s.client.PostServiceMetricValues(dest.ServiceName, values)
+	}
+	return s.client.PostHostMetricValuesByHostID(dest.HostID, values)
+}
+
+// isRetriable reports whether err should be retried rather than dropped.
+// Mackerel validation errors (4xx, except 429 rate limiting) are not
+// retriable: the request will never succeed as-is. Everything else --
+// transport errors and 429/5xx responses -- is.
+func isRetriable(err error) bool {
+	apiErr, ok := err.(*mackerel.APIError)
+	if !ok {
+		return true
+	}
+	if apiErr.StatusCode == 429 {
+		return true
+	}
+	return apiErr.StatusCode >= 500
+}
+
+const (
+	backoffBase = 1 * time.Second
+	backoffMax  = 30 * time.Second
+)
+
+// backoff returns an exponential delay for the given retry attempt
+// (1-based), jittered to a random value between half and all of it.
+func backoff(attempt int) time.Duration {
+	d := backoffBase << uint(attempt-1)
+	if d <= 0 || d > backoffMax {
+		d = backoffMax
+	}
+	return time.Duration(float64(d) * (0.5 + rand.Float64()*0.5))
+}
+
+// Stats returns a snapshot of the Submitter's self-observability counters.
+func (s *Submitter) Stats() SubmitterStats {
+	var spoolBytes int64
+	if s.spool != nil {
+		s.mu.Lock()
+		spoolBytes = s.spool.size()
+		s.mu.Unlock()
+	}
+	return SubmitterStats{
+		Enqueued:    atomic.LoadUint64(&s.enqueued),
+		Dropped:     atomic.LoadUint64(&s.dropped),
+		Retried:     atomic.LoadUint64(&s.retried),
+		SpoolBytes:  spoolBytes,
+		SpoolErrors: atomic.LoadUint64(&s.spoolErrors),
+	}
+}
+
+// spool is an append-only on-disk buffer of pending spoolEntry values.
+// Entries are appended to a single segment file as JSON lines; rewrite
+// replaces the segment's contents once its entries have been flushed or
+// permanently dropped. rotate fsyncs the old segment before truncating it;
+// appended and rewritten entries are not fsync'd, so a machine crash can
+// lose entries written since then, and a crash during a rewrite can lose
+// the entries it was writing back.
+//
+// spool is not safe for concurrent use on its own: Submitter serializes
+// every access with the same lock it uses for queue, so that an entry is
+// never in the queue without also being on disk, or vice versa.
+type spool struct {
+	dir string
+
+	f     *os.File
+	bytes int64
+}
+
+func openSpool(dir string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	sp := &spool{dir: dir}
+	// Open for append, not truncate: a segment left behind by a prior
+	// process still holds entries that haven't been flushed yet, and
+	// replay() is responsible for reading them back before anything new
+	// is appended.
+	f, err := os.OpenFile(sp.segmentPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	sp.f = f
+	sp.bytes = fi.Size()
+	return sp, nil
+}
+
+func (sp *spool) segmentPath() string {
+	return filepath.Join(sp.dir, "current.log")
+}
+
+// rotate fsyncs and closes the current segment, then starts a fresh,
+// empty one. It is only safe to call once every entry in the current
+// segment has either been delivered or permanently dropped.
+func (sp *spool) rotate() error {
+	if sp.f != nil {
+		sp.f.Sync()
+		sp.f.Close()
+	}
+	f, err := os.OpenFile(sp.segmentPath(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	sp.f = f
+	sp.bytes = 0
+	return nil
+}
+
+func (sp *spool) append(e spoolEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	n, err := sp.f.Write(append(b, '\n'))
+	sp.bytes += int64(n)
+	return err
+}
+
+// rewrite replaces the segment's contents with exactly entries, fsync'ing
+// and closing the old segment before starting the new one. Callers pass
+// the portion of the queue that a Flush did not manage to drain, so that
+// entries appended concurrently with that Flush aren't lost.
+func (sp *spool) rewrite(entries []spoolEntry) error {
+	if err := sp.rotate(); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		n, err := sp.f.Write(append(b, '\n'))
+		sp.bytes += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sp *spool) size() int64 {
+	return sp.bytes
+}
+
+// replay reads any entries left in the segment file by a prior process.
+func (sp *spool) replay() ([]spoolEntry, error) {
+	f, err := os.Open(sp.segmentPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []spoolEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e spoolEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
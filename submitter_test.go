@@ -0,0 +1,117 @@
+package mackerel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+func TestSpoolAppendReplay(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := openSpool(dir)
+	if err != nil {
+		t.Fatalf("openSpool: %v", err)
+	}
+	want := []spoolEntry{
+		{Dest: destination{HostID: "host1"}, Value: &mackerel.MetricValue{Name: "custom.a", Value: 1.0}},
+		{Dest: destination{ServiceName: "svc"}, Value: &mackerel.MetricValue{Name: "custom.b", Value: 2.0}},
+	}
+	for _, e := range want {
+		if err := sp.append(e); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	sp2, err := openSpool(dir)
+	if err != nil {
+		t.Fatalf("re-openSpool: %v", err)
+	}
+	got, err := sp2.replay()
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("replay returned %d entries, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Dest != want[i].Dest || got[i].Value.Name != want[i].Value.Name {
+			t.Fatalf("entry %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSpoolRewriteDiscardsOnlyFlushedEntries(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := openSpool(dir)
+	if err != nil {
+		t.Fatalf("openSpool: %v", err)
+	}
+	flushed := spoolEntry{Dest: destination{HostID: "host1"}, Value: &mackerel.MetricValue{Name: "custom.flushed", Value: 1.0}}
+	concurrent := spoolEntry{Dest: destination{HostID: "host1"}, Value: &mackerel.MetricValue{Name: "custom.concurrent", Value: 2.0}}
+
+	// Simulate: flushed was on disk already, then a concurrent Enqueue
+	// appended `concurrent` while a Flush was submitting `flushed`.
+	if err := sp.append(flushed); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := sp.append(concurrent); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	// The Flush completes and rewrites the spool to hold only what's
+	// still in memory -- i.e. `concurrent`, not `flushed`.
+	if err := sp.rewrite([]spoolEntry{concurrent}); err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+
+	sp2, err := openSpool(dir)
+	if err != nil {
+		t.Fatalf("re-openSpool: %v", err)
+	}
+	got, err := sp2.replay()
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if len(got) != 1 || got[0].Value.Name != "custom.concurrent" {
+		t.Fatalf("replay after rewrite = %+v, want only %q", got, "custom.concurrent")
+	}
+}
+
+func TestSubmitterFlushClearsSpoolOnSuccess(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+
+	client, err := mackerel.NewClientWithOptions("dummy", srv.URL, false)
+	if err != nil {
+		t.Fatalf("NewClientWithOptions: %v", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "spool")
+	s, err := NewSubmitter(client, SubmitterOptions{SpoolDir: dir})
+	if err != nil {
+		t.Fatalf("NewSubmitter: %v", err)
+	}
+	if err := s.Enqueue("host1", &mackerel.MetricValue{Name: "custom.a", Value: 1.0}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	s.Flush(context.Background())
+
+	stats := s.Stats()
+	if stats.SpoolBytes != 0 {
+		t.Fatalf("SpoolBytes after successful flush = %d, want 0", stats.SpoolBytes)
+	}
+	if stats.SpoolErrors != 0 {
+		t.Fatalf("SpoolErrors = %d, want 0", stats.SpoolErrors)
+	}
+	if stats.Dropped != 0 || stats.Retried != 0 {
+		t.Fatalf("Dropped/Retried = %d/%d, want 0/0", stats.Dropped, stats.Retried)
+	}
+}